@@ -0,0 +1,15 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// dirKey identifies a directory for cycle-detection purposes. Unsupported
+// on this platform.
+type dirKey struct{}
+
+// dirKeyOf always reports ok=false on this platform: cycle detection via
+// device/inode isn't available, so callers should skip the optimization.
+func dirKeyOf(fi os.FileInfo) (dirKey, bool) {
+	return dirKey{}, false
+}
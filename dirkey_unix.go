@@ -0,0 +1,25 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// dirKey identifies a directory by device & inode, so that symlink
+// traversal can detect cycles even when the same directory is reachable
+// via different paths.
+type dirKey struct {
+	dev, ino uint64
+}
+
+// dirKeyOf returns fi's dirKey. ok is false if the underlying stat_t isn't
+// available, in which case cycle detection can't be performed for fi.
+func dirKeyOf(fi os.FileInfo) (dirKey, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return dirKey{}, false
+	}
+	return dirKey{dev: uint64(st.Dev), ino: st.Ino}, true
+}
@@ -1,33 +1,125 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/hex"
 	"flag"
 	"fmt"
 	"hash"
+	"hash/crc32"
+	"hash/crc64"
 	"io"
 	"os"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
+
+	"github.com/cespare/xxhash/v2"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/sha3"
 )
 
+// HashAlgorithms is the registry of hash algorithms known to hashrename,
+// keyed by the name used with the --hash flag. It's a package-level var
+// (rather than e.g. a switch in main) so that a library-mode build could
+// register additional algorithms before main runs.
+var HashAlgorithms = map[string]func() hash.Hash{
+	"md5":        md5.New,
+	"sha1":       sha1.New,
+	"sha256":     sha256.New,
+	"sha384":     sha512.New384,
+	"sha512":     sha512.New,
+	"sha512_256": sha512.New512_256,
+	"sha3_224":   sha3.New224,
+	"sha3_256":   sha3.New256,
+	"sha3_384":   sha3.New384,
+	"sha3_512":   sha3.New512,
+	"blake2b":    newBlake2b,
+	"blake2s":    newBlake2s,
+	"xxhash":     func() hash.Hash { return xxhash.New() },
+	"crc32":      func() hash.Hash { return crc32.NewIEEE() },
+	"crc64":      func() hash.Hash { return crc64.New(crc64.MakeTable(crc64.ISO)) },
+}
+
+func newBlake2b() hash.Hash {
+	h, err := blake2b.New512(nil)
+	if err != nil {
+		panic(err) // can't happen: nil key is always valid
+	}
+	return h
+}
+
+func newBlake2s() hash.Hash {
+	h, err := blake2s.New256(nil)
+	if err != nil {
+		panic(err) // can't happen: nil key is always valid
+	}
+	return h
+}
+
+// hashNamesByHexLen maps the length of a hex-encoded digest to the names of
+// registered algorithms that produce digests of that length. Several
+// algorithms can share a length (e.g. sha256 & sha512_256 are both 64 hex
+// characters), so --check mode may need to try more than one candidate.
+func hashNamesByHexLen() map[int][]string {
+	m := map[int][]string{}
+	for name, newHash := range HashAlgorithms {
+		n := 2 * newHash().Size()
+		m[n] = append(m[n], name)
+	}
+	return m
+}
+
+func sortedHashNames() []string {
+	names := make([]string, 0, len(HashAlgorithms))
+	for name := range HashAlgorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 var (
 	dryRun              = flag.Bool("dry_run", false, "If set, do not rename files, just print what renames would occur.")
+	check               = flag.Bool("check", false, "If set, do not rename files; instead, verify that each file's current name matches its content hash (the hash algorithm is auto-detected from the filename). Exits non-zero if any file fails verification.")
 	concurrency         = flag.Int("concurrency", 0, "The number of files to process at once. If unset, a reasonable value will be chosen automatically.")
-	hashName            = flag.String("hash", "sha512_256", "The hash to use. Supported values include `sha1` & `sha512_256`.")
-	skipHashedFilenames = flag.Bool("skip_hashed_filenames", true, "If set, skip files whose names appear to already be a hash. (Does not check that the hash is correct.)")
+	hashName            = flag.String("hash", "sha512_256", fmt.Sprintf("The hash to use. Supported values: %s. Ignored in --check mode, where the hash is auto-detected per file.", strings.Join(sortedHashNames(), ", ")))
+	skipHashedFilenames = flag.Bool("skip_hashed_filenames", true, "If set, skip files whose names appear to already be a hash. (Does not check that the hash is correct.) Ignored in --check mode.")
+	bufferSize          = flag.Int("buffer_size", 2*1024*1024, "The size, in bytes, of the buffer used to read files that aren't mmap'd.")
+	mmapThreshold       = flag.Int64("mmap_threshold", 64*1024*1024, "Files at least this many bytes are read via mmap instead of a buffered copy. Set to a negative value to disable mmap.")
+	recursive           = flag.Bool("recursive", false, "If set, treat each argument as a directory to walk recursively, rather than a glob.")
+	followSymlinks      = flag.String("follow_symlinks", "never", "Whether to follow symlinks found while walking a --recursive tree: `never`, `files` (follow symlinks to files, not directories), or `all`.")
+	manifestPath        = flag.String("manifest", "", "If set, write a record of each rename performed (hash and original path, one per line) to this path. Ignored in --check mode.")
+	undoPath            = flag.String("undo", "", "If set, read a manifest previously written via --manifest and reverse the renames it records, instead of processing globs/dirs.")
+	onCollision         = flag.String("on_collision", "overwrite", "What to do when a file's hash-derived name already exists: `overwrite` the existing file, `skip` the rename, report an `error`, or `dedupe` (verify the existing file has identical content, then remove the duplicate).")
 )
 
+// bufferPool holds reusable buffers for io.CopyBuffer, sized per
+// --buffer_size, avoiding a fresh allocation per file.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return make([]byte, *bufferSize) },
+}
+
 func main() {
 	// Parse & validate flags.
 	flag.Parse()
+	if *undoPath != "" {
+		undo(*undoPath)
+		return
+	}
 	if len(flag.Args()) == 0 {
-		die("Usage: hashrename [--dry_run] [--concurrency=N] [--hash=sha512_256] globs")
+		die("Usage: hashrename [--dry_run] [--check] [--concurrency=N] [--hash=sha512_256] [--recursive] [--manifest=PATH] [--on_collision=overwrite] globs-or-dirs\n" +
+			"   or: hashrename --undo=PATH [--dry_run]")
 	}
 	switch {
 	case *concurrency == 0:
@@ -35,21 +127,31 @@ func main() {
 	case *concurrency < 0:
 		die("The --concurrency flag must be non-negative.")
 	}
+	if *bufferSize <= 0 {
+		die("The --buffer_size flag must be positive.")
+	}
 	var newHash func() hash.Hash
-	switch *hashName {
-	case "sha1":
-		newHash = sha1.New
-	case "sha512_256":
-		newHash = sha512.New512_256
-	default:
-		die("Unknown --hash value %q", *hashName)
+	if !*check {
+		var ok bool
+		newHash, ok = HashAlgorithms[*hashName]
+		if !ok {
+			die("Unknown --hash value %q", *hashName)
+		}
 	}
 
 	fnFilter := func(string) bool { return true }
-	if *skipHashedFilenames {
-		// Build & hash some data to figure out how big a filename hash will be.
-		hLen := 2 * newHash().Size() // times 2 to account for hex-encoding
-		r, err := regexp.Compile(fmt.Sprintf(`^[0-9a-f]{%d}(\..*)?$`, hLen))
+	if *skipHashedFilenames && !*check {
+		// Build a regex matching any registered hash's hex-encoded length.
+		var lens []int
+		for l := range hashNamesByHexLen() {
+			lens = append(lens, l)
+		}
+		sort.Ints(lens)
+		alts := make([]string, len(lens))
+		for i, l := range lens {
+			alts[i] = fmt.Sprintf("[0-9a-f]{%d}", l)
+		}
+		r, err := regexp.Compile(fmt.Sprintf(`^(?:%s)(\..*)?$`, strings.Join(alts, "|")))
 		if err != nil {
 			die("Couldn't compile filter regex: %v", err)
 		}
@@ -57,6 +159,37 @@ func main() {
 		fnFilter = func(fn string) bool { return !r.MatchString(filepath.Base(fn)) }
 	}
 
+	// Start the manifest writer, if requested. Writes are serialized through
+	// this single goroutine (rather than a mutex shared by the workers) so
+	// that manifest lines never interleave.
+	var manifestCh chan renameRecord
+	var manifestWG sync.WaitGroup
+	if *manifestPath != "" && !*check {
+		mf, err := os.Create(*manifestPath)
+		if err != nil {
+			die("Couldn't create manifest %q: %v", *manifestPath, err)
+		}
+		manifestCh = make(chan renameRecord, *concurrency)
+		manifestWG.Add(1)
+		go func() {
+			defer manifestWG.Done()
+			defer mf.Close()
+			w := bufio.NewWriter(mf)
+			defer w.Flush()
+			for rec := range manifestCh {
+				if rec.deduped {
+					// A dedupe removal isn't reversible: the source's bytes
+					// are gone, not moved to rec.hash, so undo can't restore
+					// it (and if other duplicates share rec.hash, a naive
+					// rename-back would steal the file out from under them).
+					fmt.Fprintf(w, "DEDUPE %s  %s\n", rec.hash, rec.original)
+					continue
+				}
+				fmt.Fprintf(w, "%s  %s\n", rec.hash, rec.original)
+			}
+		}()
+	}
+
 	// Start per-file workers.
 	var wg sync.WaitGroup
 	var errCount int64
@@ -65,43 +198,23 @@ func main() {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			h := newHash()
+			var h hash.Hash
+			if !*check {
+				h = newHash()
+			}
 			for fn := range ch {
-				if err := func() error {
-					// Check filter.
-					if !fnFilter(fn) {
-						return nil
-					}
-
-					// Hash file.
-					f, err := os.Open(fn)
-					if err != nil {
-						return fmt.Errorf("couldn't open: %w", err)
+				var err error
+				if *check {
+					err = checkFile(fn)
+				} else {
+					var newFn string
+					var outcome moveOutcome
+					newFn, outcome, err = renameFile(fn, h, fnFilter)
+					if err == nil && outcome != moveNone && manifestCh != nil {
+						manifestCh <- renameRecord{hash: hashPartOf(newFn), original: fn, deduped: outcome == moveDeduped}
 					}
-					defer f.Close()
-					h.Reset()
-					if _, err := io.Copy(h, f); err != nil {
-						return fmt.Errorf("couldn't read: %w", err)
-					}
-					if err := f.Close(); err != nil {
-						return fmt.Errorf("couldn't close: %w", err)
-					}
-
-					// Move file to new filename based on hash.
-					newFn := hex.EncodeToString(h.Sum(nil))
-					ext := filepath.Ext(fn)
-					if ext != "" {
-						newFn = fmt.Sprintf("%s%s", newFn, ext)
-					}
-					newFn = filepath.Join(filepath.Dir(fn), newFn)
-					fmt.Printf("%s -> %s\n", fn, newFn)
-					if !*dryRun {
-						if err := os.Rename(fn, newFn); err != nil {
-							return fmt.Errorf("couldn't rename: %w")
-						}
-					}
-					return nil
-				}(); err != nil {
+				}
+				if err != nil {
 					atomic.AddInt64(&errCount, 1)
 					fmt.Fprintf(os.Stderr, "Couldn't handle %q: %v\n", fn, err)
 				}
@@ -109,28 +222,332 @@ func main() {
 		}()
 	}
 
-	// Find files to rename. (find all files before renaming anything to ensure we handle each file only once)
-	files := map[string]struct{}{}
-	for _, glob := range flag.Args() {
-		fns, err := filepath.Glob(glob)
-		if err != nil {
-			die("Bad glob %q: %v", glob, err)
+	// Find & enqueue files to process, streaming discoveries to the workers
+	// as they're found rather than buffering the whole tree up front.
+	fileCount, err := discoverFiles(flag.Args(), ch)
+	close(ch)
+	if err != nil {
+		wg.Wait()
+		die("%v", err)
+	}
+	wg.Wait()
+	if manifestCh != nil {
+		close(manifestCh)
+		manifestWG.Wait()
+	}
+	fmt.Printf("Processed %d file(s)\n", fileCount)
+	if errCount > 0 {
+		if *check {
+			die("Encountered %d mismatch(es)/error(s)", errCount)
 		}
-		for _, fn := range fns {
-			files[fn] = struct{}{}
+		die("Encountered %d errors", errCount)
+	}
+}
+
+// hashFile reads fn's contents once and writes them to each of writers
+// (typically one or more hash.Hash values). Files at least --mmap_threshold
+// bytes are read via mmap, feeding the mapped region directly to writers
+// without an intermediate copy; all other files (and any file for which
+// mmap fails, e.g. on platforms without support) are read via a pooled
+// buffer and io.CopyBuffer.
+func hashFile(fn string, writers ...io.Writer) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return fmt.Errorf("couldn't open: %w", err)
+	}
+	defer f.Close()
+
+	w := io.MultiWriter(writers...)
+
+	if fi, err := f.Stat(); err == nil && *mmapThreshold >= 0 && fi.Size() >= *mmapThreshold && fi.Size() > 0 {
+		if data, err := mmapFile(f, fi.Size()); err == nil {
+			_, werr := w.Write(data)
+			uerr := munmapFile(data)
+			if werr != nil {
+				return fmt.Errorf("couldn't read (mmap): %w", werr)
+			}
+			if uerr != nil {
+				return fmt.Errorf("couldn't munmap: %w", uerr)
+			}
+			if err := f.Close(); err != nil {
+				return fmt.Errorf("couldn't close: %w", err)
+			}
+			return nil
 		}
+		// mmap failed (e.g. unsupported platform); fall back to buffered copy below.
 	}
-	fmt.Printf("Processing %d file(s)\n", len(files))
-	for fn := range files {
-		ch <- fn
+
+	buf := bufferPool.Get().([]byte)
+	defer bufferPool.Put(buf)
+	if _, err := io.CopyBuffer(w, f, buf); err != nil {
+		return fmt.Errorf("couldn't read: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("couldn't close: %w", err)
+	}
+	return nil
+}
+
+// renameRecord is a single line of a --manifest file: the hash a file was
+// renamed to, and the original path it was renamed from. deduped marks a
+// record as a --on_collision=dedupe removal rather than a real rename: the
+// original's bytes were deleted, not preserved under hash, so it can't be
+// undone the same way (see undo).
+type renameRecord struct {
+	hash     string
+	original string
+	deduped  bool
+}
+
+// moveOutcome describes what, if anything, renameFile/rename did to fn.
+type moveOutcome int
+
+const (
+	moveNone    moveOutcome = iota // fn untouched (filtered out, or --dry_run)
+	moveRenamed                    // fn renamed to newFn
+	moveDeduped                    // fn removed; an identical newFn already existed
+)
+
+// renameFile hashes fn's contents using h and renames fn to a name derived
+// from the hash, preserving fn's extension (if any). If fnFilter(fn) is
+// false, fn is left untouched. outcome reports what happened (always
+// moveNone in --dry_run mode).
+func renameFile(fn string, h hash.Hash, fnFilter func(string) bool) (newFn string, outcome moveOutcome, err error) {
+	if !fnFilter(fn) {
+		return "", moveNone, nil
+	}
+
+	// Hash file.
+	h.Reset()
+	if err := hashFile(fn, h); err != nil {
+		return "", moveNone, err
+	}
+
+	// Move file to new filename based on hash.
+	newFn = hex.EncodeToString(h.Sum(nil))
+	ext := filepath.Ext(fn)
+	if ext != "" {
+		newFn = fmt.Sprintf("%s%s", newFn, ext)
+	}
+	newFn = filepath.Join(filepath.Dir(fn), newFn)
+	fmt.Printf("%s -> %s\n", fn, newFn)
+	if *dryRun {
+		return newFn, moveNone, nil
+	}
+	outcome, err = rename(fn, newFn, h.Sum(nil))
+	if err != nil {
+		return "", moveNone, err
+	}
+	return newFn, outcome, nil
+}
+
+// collisionPolicy controls what rename does when its destination already
+// exists.
+type collisionPolicy string
+
+const (
+	collisionOverwrite collisionPolicy = "overwrite"
+	collisionSkip      collisionPolicy = "skip"
+	collisionError     collisionPolicy = "error"
+	collisionDedupe    collisionPolicy = "dedupe"
+)
+
+func (p collisionPolicy) valid() bool {
+	switch p {
+	case collisionOverwrite, collisionSkip, collisionError, collisionDedupe:
+		return true
+	}
+	return false
+}
+
+// destLocks serializes collision resolution per destination name: workers
+// run concurrently, so without this, two workers could both see newFn as
+// absent (or as an existing file to dedupe-compare against) before either
+// had finished acting on it, letting a later os.Rename silently clobber an
+// earlier one regardless of --on_collision.
+var (
+	destLocksMu sync.Mutex
+	destLocks   = map[string]*sync.Mutex{}
+)
+
+// lockDest locks the mutex associated with newFn (creating it on first use)
+// and returns a function that unlocks it.
+func lockDest(newFn string) func() {
+	destLocksMu.Lock()
+	l, ok := destLocks[newFn]
+	if !ok {
+		l = &sync.Mutex{}
+		destLocks[newFn] = l
+	}
+	destLocksMu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// rename renames fn to newFn, whose name is derived from digest (fn's
+// content hash). If newFn already exists, the rename is instead resolved
+// per --on_collision, and a message describing the branch taken is printed.
+// outcome reports what happened to fn: moveRenamed if it was moved to
+// newFn, moveDeduped if it was removed as a duplicate of an already-present
+// newFn, or moveNone if it was left in place (a skip). The whole check
+// (does newFn exist?) and the action taken on it are serialized per newFn
+// via destLocks, so concurrent workers racing for the same destination
+// resolve the collision instead of both succeeding.
+func rename(fn, newFn string, digest []byte) (outcome moveOutcome, err error) {
+	defer lockDest(newFn)()
+
+	if _, err := os.Lstat(newFn); err != nil {
+		if !os.IsNotExist(err) {
+			return moveNone, fmt.Errorf("couldn't stat %q: %w", newFn, err)
+		}
+		if err := os.Rename(fn, newFn); err != nil {
+			return moveNone, fmt.Errorf("couldn't rename: %w", err)
+		}
+		return moveRenamed, nil
+	}
+
+	policy := collisionPolicy(*onCollision)
+	if !policy.valid() {
+		return moveNone, fmt.Errorf("unknown --on_collision value %q", *onCollision)
+	}
+	switch policy {
+	case collisionOverwrite:
+		if err := os.Rename(fn, newFn); err != nil {
+			return moveNone, fmt.Errorf("couldn't rename (overwrite): %w", err)
+		}
+		fmt.Printf("%s: OVERWRITE (%s already existed)\n", fn, newFn)
+		return moveRenamed, nil
+
+	case collisionSkip:
+		fmt.Printf("%s: SKIP (%s already exists)\n", fn, newFn)
+		return moveNone, nil
+
+	case collisionError:
+		return moveNone, fmt.Errorf("%q already exists", newFn)
+
+	default: // collisionDedupe
+		targetHash := HashAlgorithms[*hashName]()
+		if err := hashFile(newFn, targetHash); err != nil {
+			return moveNone, fmt.Errorf("couldn't hash existing %q: %w", newFn, err)
+		}
+		if !bytes.Equal(targetHash.Sum(nil), digest) {
+			return moveNone, fmt.Errorf("%q already exists with different content (hash collision?)", newFn)
+		}
+		if err := os.Remove(fn); err != nil {
+			return moveNone, fmt.Errorf("couldn't remove duplicate: %w", err)
+		}
+		fmt.Printf("%s: DEDUPE (identical to existing %s; removed duplicate)\n", fn, newFn)
+		return moveDeduped, nil
+	}
+}
+
+// undo reverses the renames recorded in the manifest at path (as written by
+// --manifest), renaming each hash-named file back to its original path.
+// Honors --dry_run.
+func undo(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		die("Couldn't open manifest %q: %v", path, err)
+	}
+	defer f.Close()
+
+	var errCount int64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "DEDUPE "); ok {
+			_, original, ok := strings.Cut(rest, "  ")
+			if !ok {
+				errCount++
+				fmt.Fprintf(os.Stderr, "Couldn't parse manifest line %q\n", line)
+				continue
+			}
+			// The original's bytes were deleted at dedupe time, not moved
+			// to the hash-named file (which may be shared by other
+			// duplicates), so there's nothing to rename back.
+			fmt.Fprintf(os.Stderr, "Can't undo %q: removed by --on_collision=dedupe, not reversible\n", original)
+			continue
+		}
+		hashHex, original, ok := strings.Cut(line, "  ")
+		if !ok {
+			errCount++
+			fmt.Fprintf(os.Stderr, "Couldn't parse manifest line %q\n", line)
+			continue
+		}
+		newFn := filepath.Join(filepath.Dir(original), hashHex+filepath.Ext(original))
+		fmt.Printf("%s -> %s\n", newFn, original)
+		if *dryRun {
+			continue
+		}
+		if err := os.Rename(newFn, original); err != nil {
+			errCount++
+			fmt.Fprintf(os.Stderr, "Couldn't undo %q: %v\n", original, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		die("Couldn't read manifest %q: %v", path, err)
 	}
-	close(ch)
-	wg.Wait()
 	if errCount > 0 {
 		die("Encountered %d errors", errCount)
 	}
 }
 
+// checkFile verifies that fn's basename (with any extension stripped) is the
+// hex-encoded hash of fn's contents, auto-detecting the hash algorithm from
+// the length of the hex string (trying every registered algorithm that
+// produces a digest of that length). It reports "OK" or "MISMATCH" to
+// stdout and returns a non-nil error if the name doesn't look like a hash,
+// no candidate algorithm matches, or the hash doesn't match.
+func checkFile(fn string) error {
+	stem := hashPartOf(fn)
+
+	candidates := hashNamesByHexLen()[len(stem)]
+	if len(candidates) == 0 || !isHex(stem) {
+		fmt.Printf("%s: UNKNOWN\n", fn)
+		return fmt.Errorf("filename doesn't look like a recognized hash")
+	}
+
+	hashes := make([]hash.Hash, len(candidates))
+	writers := make([]io.Writer, len(candidates))
+	for i, name := range candidates {
+		hashes[i] = HashAlgorithms[name]()
+		writers[i] = hashes[i]
+	}
+	if err := hashFile(fn, writers...); err != nil {
+		return err
+	}
+	for i, name := range candidates {
+		if got := hex.EncodeToString(hashes[i].Sum(nil)); got == stem {
+			fmt.Printf("%s: OK (%s)\n", fn, name)
+			return nil
+		}
+	}
+	fmt.Printf("%s: MISMATCH (tried %s)\n", fn, strings.Join(candidates, ", "))
+	return fmt.Errorf("hash mismatch: tried %s", strings.Join(candidates, ", "))
+}
+
+// hashPartOf returns path's basename with its extension (if any) stripped
+// — i.e. the part of a hash-renamed file's name that should be its hash.
+func hashPartOf(path string) string {
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+func isHex(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= '0' && r <= '9') && !(r >= 'a' && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
 func die(format string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, format+"\n", args...)
 	os.Exit(1)
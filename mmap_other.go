@@ -0,0 +1,20 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// mmapFile maps the first size bytes of f into memory for reading. mmap
+// isn't supported on this platform, so callers always fall back to the
+// buffered path.
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	return nil, errors.New("mmap not supported on this platform")
+}
+
+// munmapFile unmaps data previously returned by mmapFile.
+func munmapFile(data []byte) error {
+	return nil
+}
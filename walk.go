@@ -0,0 +1,231 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// patternList is a flag.Value accumulating repeated --include/--exclude
+// regex flags.
+type patternList struct {
+	raw      []string
+	compiled []*regexp.Regexp
+}
+
+func (p *patternList) String() string {
+	if p == nil {
+		return ""
+	}
+	return strings.Join(p.raw, ",")
+}
+
+func (p *patternList) Set(s string) error {
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return fmt.Errorf("bad pattern %q: %w", s, err)
+	}
+	p.raw = append(p.raw, s)
+	p.compiled = append(p.compiled, re)
+	return nil
+}
+
+func (p *patternList) matchAny(s string) bool {
+	for _, re := range p.compiled {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	includePatterns patternList
+	excludePatterns patternList
+)
+
+func init() {
+	flag.Var(&includePatterns, "include", "Regex matched against each file's path relative to its --recursive root; if given (may be repeated), only matching files are processed.")
+	flag.Var(&excludePatterns, "exclude", "Regex matched against each file's path relative to its --recursive root; matching files are skipped. May be repeated. Takes precedence over --include.")
+}
+
+// matchesFilters reports whether rel (a path relative to the walk's root)
+// passes --include/--exclude.
+func matchesFilters(rel string) bool {
+	if len(excludePatterns.compiled) > 0 && excludePatterns.matchAny(rel) {
+		return false
+	}
+	if len(includePatterns.compiled) > 0 && !includePatterns.matchAny(rel) {
+		return false
+	}
+	return true
+}
+
+// symlinkPolicy controls which symlinks discoverFiles follows.
+type symlinkPolicy string
+
+const (
+	symlinksNever symlinkPolicy = "never"
+	symlinksFiles symlinkPolicy = "files"
+	symlinksAll   symlinkPolicy = "all"
+)
+
+func (p symlinkPolicy) valid() bool {
+	switch p {
+	case symlinksNever, symlinksFiles, symlinksAll:
+		return true
+	}
+	return false
+}
+
+// discoverFiles finds the files named by args, sending each exactly once to
+// ch as it's discovered (rather than buffering the full list up front) and
+// returning the total number enqueued. If *recursive is set, each arg is
+// treated as a root directory to walk (honoring --include, --exclude &
+// --follow_symlinks); otherwise each arg is treated as a glob, as before.
+func discoverFiles(args []string, ch chan<- string) (int64, error) {
+	var count int64
+	seen := map[string]struct{}{}
+	send := func(path string) {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			abs = path
+		}
+		if _, ok := seen[abs]; ok {
+			return
+		}
+		seen[abs] = struct{}{}
+		count++
+		ch <- path
+	}
+
+	if !*recursive {
+		for _, glob := range args {
+			fns, err := filepath.Glob(glob)
+			if err != nil {
+				return count, fmt.Errorf("bad glob %q: %w", glob, err)
+			}
+			for _, fn := range fns {
+				send(fn)
+			}
+		}
+		return count, nil
+	}
+
+	policy := symlinkPolicy(*followSymlinks)
+	if !policy.valid() {
+		return count, fmt.Errorf("unknown --follow_symlinks value %q", *followSymlinks)
+	}
+	visitedDirs := map[dirKey]bool{}
+	for _, root := range args {
+		if err := walkRoot(root, policy, visitedDirs, send); err != nil {
+			return count, fmt.Errorf("couldn't walk %q: %w", root, err)
+		}
+	}
+	return count, nil
+}
+
+// walkRoot applies --follow_symlinks to root itself (a command-line
+// argument) before handing off to walkDir, so a symlinked root is subject
+// to the same policy as a symlink encountered mid-walk rather than always
+// being walked.
+func walkRoot(root string, policy symlinkPolicy, visited map[dirKey]bool, send func(string)) error {
+	lfi, err := os.Lstat(root)
+	if err != nil {
+		return err
+	}
+	if lfi.Mode()&fs.ModeSymlink == 0 {
+		return walkDir(root, root, policy, visited, send)
+	}
+
+	if policy == symlinksNever {
+		return nil
+	}
+	fi, err := os.Stat(root) // follows the symlink
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		if policy == symlinksAll && shouldDescend(fi, visited) {
+			return walkDir(root, root, policy, visited, send)
+		}
+		return nil
+	}
+	if matchesFilters(filepath.Base(root)) {
+		send(root)
+	}
+	return nil
+}
+
+// walkDir recursively visits dir (part of the tree rooted at root),
+// reporting files that pass matchesFilters to send.
+func walkDir(root, dir string, policy symlinkPolicy, visited map[dirKey]bool, send func(string)) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			rel = path
+		}
+
+		if entry.Type()&fs.ModeSymlink != 0 {
+			if policy == symlinksNever {
+				continue
+			}
+			fi, err := os.Stat(path) // follows the symlink
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Couldn't stat %q: %v\n", path, err)
+				continue
+			}
+			if fi.IsDir() {
+				if policy == symlinksAll && shouldDescend(fi, visited) {
+					if err := walkDir(root, path, policy, visited, send); err != nil {
+						fmt.Fprintf(os.Stderr, "Couldn't walk %q: %v\n", path, err)
+					}
+				}
+				continue
+			}
+			if matchesFilters(rel) {
+				send(path)
+			}
+			continue
+		}
+
+		if entry.IsDir() {
+			fi, err := entry.Info()
+			if err == nil && shouldDescend(fi, visited) {
+				if err := walkDir(root, path, policy, visited, send); err != nil {
+					fmt.Fprintf(os.Stderr, "Couldn't walk %q: %v\n", path, err)
+				}
+			}
+			continue
+		}
+
+		if matchesFilters(rel) {
+			send(path)
+		}
+	}
+	return nil
+}
+
+// shouldDescend reports whether a directory with the given info hasn't been
+// visited yet, recording it as visited if so. Directories whose dirKey
+// can't be determined are always descended into (no cycle protection).
+func shouldDescend(fi os.FileInfo, visited map[dirKey]bool) bool {
+	key, ok := dirKeyOf(fi)
+	if !ok {
+		return true
+	}
+	if visited[key] {
+		return false
+	}
+	visited[key] = true
+	return true
+}